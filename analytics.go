@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// statsBucket is how clicks-over-time is grouped for /{slug}/stats;
+// ?bucket= selects one of these.
+type statsBucket string
+
+const (
+	bucketHour statsBucket = "hour"
+	bucketDay  statsBucket = "day"
+	bucketWeek statsBucket = "week"
+
+	dailyAggregationInterval = time.Hour
+)
+
+// UTMParams is the subset of UTM query parameters scvl records against a
+// PageView, so referrer campaigns can be broken out in the dashboard.
+type UTMParams struct {
+	Source   string
+	Medium   string
+	Campaign string
+}
+
+func parseUTMParams(r *http.Request) UTMParams {
+	q := r.URL.Query()
+	return UTMParams{
+		Source:   q.Get("utm_source"),
+		Medium:   q.Get("utm_medium"),
+		Campaign: q.Get("utm_campaign"),
+	}
+}
+
+// GeoResolver looks up a country/city for an IP, so the stats dashboard
+// can break clicks down geographically without hard-coding a provider.
+type GeoResolver interface {
+	Lookup(ip string) (country, city string, err error)
+}
+
+// maxMindResolver is the default GeoResolver, backed by a local MaxMind
+// GeoLite2/GeoIP2 City database.
+type maxMindResolver struct {
+	db *geoip2.Reader
+}
+
+func newMaxMindResolver(path string) (*maxMindResolver, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &maxMindResolver{db: db}, nil
+}
+
+func (m *maxMindResolver) Lookup(ip string) (country, city string, err error) {
+	record, err := m.db.City(net.ParseIP(ip))
+	if err != nil {
+		return "", "", err
+	}
+	return record.Country.IsoCode, record.City.Names["en"], nil
+}
+
+var geoResolver GeoResolver
+
+// setupGeoResolver configures geoResolver from GEOIP_DB_PATH. Geo lookups
+// are best-effort, so a missing/unreadable database just leaves
+// geoResolver nil and the dashboard omits the geography breakdown.
+func setupGeoResolver() {
+	path := os.Getenv("GEOIP_DB_PATH")
+	if path == "" {
+		return
+	}
+	resolver, err := newMaxMindResolver(path)
+	if err != nil {
+		log.Printf("Failed to open GeoIP database at %s: %v", path, err)
+		return
+	}
+	geoResolver = resolver
+}
+
+// startPageViewAggregator periodically rolls raw PageView rows into
+// PageViewDaily summaries so /{slug}/stats doesn't have to scan the full
+// table on every request.
+func startPageViewAggregator() {
+	ticker := time.NewTicker(dailyAggregationInterval)
+	go func() {
+		for range ticker.C {
+			if err := manager.aggregatePageViewsDaily(); err != nil {
+				log.Printf("Failed to aggregate page views: %v", err)
+			}
+		}
+	}()
+}
+
+// statsHandler renders the clicks-over-time / referrer / browser /
+// geography breakdown for a page, reusing the same ownership check as
+// editHandler.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := ownedPageOrError(w, r)
+	if !ok {
+		return
+	}
+
+	bucket := parseStatsBucket(r)
+	stats, err := manager.pageStats(page.ID, bucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "/stats.tpl", map[string]interface{}{
+		"Page":   page,
+		"Stats":  stats,
+		"Bucket": bucket,
+	})
+}
+
+func statsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := ownedPageOrError(w, r)
+	if !ok {
+		return
+	}
+	stats, err := manager.pageStats(page.ID, parseStatsBucket(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// parseStatsBucket reads ?bucket= off the request, defaulting to
+// bucketDay and falling back to it for any unrecognized value so a typo
+// in the query string doesn't silently request an unbounded query.
+func parseStatsBucket(r *http.Request) statsBucket {
+	switch b := statsBucket(r.URL.Query().Get("bucket")); b {
+	case bucketHour, bucketDay, bucketWeek:
+		return b
+	default:
+		return bucketDay
+	}
+}
+
+func statsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := ownedPageOrError(w, r)
+	if !ok {
+		return
+	}
+	views, err := manager.pageViews(page.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+page.Slug+"-stats.csv\"")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"created_at", "referer", "browser", "os", "platform", "mobile", "utm_source", "utm_medium", "utm_campaign"})
+	for _, v := range views {
+		cw.Write([]string{
+			v.CreatedAt.Format(time.RFC3339), v.Referer, v.BrowserName, v.OS, v.Platform,
+			strconv.FormatBool(v.Mobile), v.UTMSource, v.UTMMedium, v.UTMCampaign,
+		})
+	}
+	cw.Flush()
+}
+
+// ownedPageOrError resolves {slug} and enforces the same ownership check
+// editHandler and updateHandler already use, for the three stats
+// endpoints above.
+func ownedPageOrError(w http.ResponseWriter, r *http.Request) (Page, bool) {
+	user, ok := context.Get(r, "user").(*User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return Page{}, false
+	}
+	slug := mux.Vars(r)["slug"]
+	page, err := manager.findPageBySlug(slug)
+	if err != nil {
+		http.Error(w, "The page you are looking for is not found.", http.StatusNotFound)
+		return Page{}, false
+	}
+	if page.UserID != int(user.ID) {
+		http.Error(w, "You don't have permission to view it.", http.StatusUnauthorized)
+		return Page{}, false
+	}
+	return page, true
+}
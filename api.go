@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+const (
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+)
+
+// apiError is the error envelope returned by every /api/v1 endpoint, so
+// clients get a consistent shape regardless of which handler failed.
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	e := apiError{}
+	e.Error.Message = message
+	writeJSON(w, status, e)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// sessionUser resolves the *User from the "scvl" session cookie, if any,
+// the same way the authenticate middleware does. apiAuthenticate falls
+// back to it when no bearer token is sent.
+func sessionUser(r *http.Request) (*User, bool) {
+	session, _ := store.Get(r, "scvl")
+	userID, ok := session.Values["user_id"].(uint)
+	if !ok {
+		return nil, false
+	}
+	user, err := manager.findUser(userID)
+	if err != nil {
+		return nil, false
+	}
+	return &user, true
+}
+
+// hashAPIToken stores only the SHA-256 of an API token, mirroring how a
+// bearer token should never be recoverable from the database it's
+// persisted in.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiAuthenticate authenticates either an `Authorization: Bearer <token>`
+// API token or an existing session cookie, so the same JSON handlers work
+// for scripts and for the dashboard's own fetch calls.
+func apiAuthenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			token := strings.TrimPrefix(authHeader, "Bearer ")
+			user, err := manager.findUserByAPIToken(hashAPIToken(token))
+			if err != nil {
+				writeAPIError(w, http.StatusUnauthorized, "invalid API token")
+				return
+			}
+			context.Set(r, "user", &user)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if user, ok := sessionUser(r); ok {
+			context.Set(r, "user", user)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		writeAPIError(w, http.StatusUnauthorized, "authentication required")
+	}
+}
+
+// apiShortenHandler is the JSON equivalent of shortenHandler.
+func apiShortenHandler(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "user").(*User)
+
+	limited, retryAfter, err := checkShortenRateLimit(user)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeAPIError(w, http.StatusTooManyRequests, "too many shorten requests, please slow down")
+		return
+	}
+
+	var req struct {
+		URL       string `json:"url"`
+		Slug      string `json:"slug"`
+		ExpiresAt string `json:"expires_at"`
+		MaxClicks int    `json:"max_clicks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.URL == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "url cannot be empty")
+		return
+	}
+	if blocked, reason, err := scanURL(req.URL); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if blocked {
+		writeAPIError(w, http.StatusUnprocessableEntity, "URL rejected: "+reason)
+		return
+	}
+
+	slug := req.Slug
+	if slug == "" {
+		slug = generateSlug()
+	} else if err := validateSlug(slug); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	expiresAt, err := parseExpiresAt(req.ExpiresAt)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	page, err := manager.createPage(user.ID, slug, req.URL, expiresAt, req.MaxClicks)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	client.SetURLWithExpiry(slug, req.URL, expiresAt)
+	client.resetClickLimit(slug, req.MaxClicks)
+	writeJSON(w, http.StatusCreated, page)
+}
+
+// apiListPagesHandler lists the authenticated user's pages, paginated via
+// ?page= and ?per_page=.
+func apiListPagesHandler(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "user").(*User)
+
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			page = n
+		}
+	}
+	perPage := apiDefaultPerPage
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= apiMaxPerPage {
+			perPage = n
+		}
+	}
+
+	pages, total, err := manager.listPagesForUser(user.ID, page, perPage)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pages": pages,
+		"pagination": map[string]int{
+			"page":     page,
+			"per_page": perPage,
+			"total":    total,
+		},
+	})
+}
+
+// apiGetPageHandler returns a single page, honoring If-None-Match against
+// an ETag derived from the page's slug, URL, expiry and click limit (see
+// pageETag) so polling clients can cheaply
+// no-op when nothing changed.
+func apiGetPageHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := apiFindOwnedPage(w, r)
+	if !ok {
+		return
+	}
+
+	etag := pageETag(page)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func apiUpdatePageHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := apiFindOwnedPage(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL       string `json:"url"`
+		ExpiresAt string `json:"expires_at"`
+		MaxClicks int    `json:"max_clicks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.URL == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "url cannot be empty")
+		return
+	}
+	expiresAt, err := parseExpiresAt(req.ExpiresAt)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err := manager.updatePage(page.ID, req.URL, expiresAt, req.MaxClicks); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	client.SetURLWithExpiry(page.Slug, req.URL, expiresAt)
+	client.resetClickLimit(page.Slug, req.MaxClicks)
+	page.URL = req.URL
+	page.ExpiresAt = expiresAt
+	page.MaxClicks = req.MaxClicks
+	writeJSON(w, http.StatusOK, page)
+}
+
+func apiDeletePageHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := apiFindOwnedPage(w, r)
+	if !ok {
+		return
+	}
+	if err := manager.deletePage(page.ID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	client.DeleteURL(page.Slug)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiPageStatsHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := apiFindOwnedPage(w, r)
+	if !ok {
+		return
+	}
+	stats, err := manager.pageStats(page.ID, parseStatsBucket(r))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// apiFindOwnedPage resolves {slug} and checks ownership, writing the
+// appropriate JSON error and returning ok=false if either check fails.
+func apiFindOwnedPage(w http.ResponseWriter, r *http.Request) (Page, bool) {
+	user := context.Get(r, "user").(*User)
+	slug := mux.Vars(r)["slug"]
+
+	page, err := manager.findPageBySlug(slug)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "page not found")
+		return Page{}, false
+	}
+	if page.UserID != int(user.ID) {
+		writeAPIError(w, http.StatusForbidden, "you don't have permission to access this page")
+		return Page{}, false
+	}
+	return page, true
+}
+
+// DeleteURL removes a slug's cached redirect target, used when a page is
+// deleted via the API so stale entries don't linger in redis.
+func (c *redisClient) DeleteURL(slug string) {
+	c.conn.Del(slug)
+}
+
+func pageETag(page Page) string {
+	expiresAt := ""
+	if page.ExpiresAt != nil {
+		expiresAt = page.ExpiresAt.Format(time.RFC3339)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d", page.Slug, page.URL, expiresAt, page.MaxClicks)))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// tokensHandler lists the authenticated user's API tokens (GET) or mints
+// a new one (POST). The raw token is only ever returned once, at
+// creation time; only its hash is persisted.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := context.Get(r, "user").(*User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		token, err := generateResetToken() // reuses the same crypto/rand token generator
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := manager.createAPIToken(user.ID, hashAPIToken(token)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bytes, _ := json.Marshal(map[string]string{"Token": token})
+		setFlash(w, "message", bytes)
+		http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+		return
+	}
+
+	bytes, _ := getFlash(w, r, "message")
+	resp := map[string]interface{}{}
+	if bytes != nil {
+		json.Unmarshal(bytes, &resp)
+	}
+	tokens, err := manager.listAPITokens(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp["Tokens"] = tokens
+	renderTemplate(w, r, "/account/tokens.tpl", resp)
+}
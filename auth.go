@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/gitlab"
+	"golang.org/x/oauth2/google"
+)
+
+// OAuthProvider is implemented by every identity provider scvl can log a
+// user in through. main populates authRegistry with one instance per
+// provider that has credentials configured in the environment.
+type OAuthProvider interface {
+	// Name is the URL-safe identifier used in /oauth/{name}/callback and
+	// as the ProviderUID namespace on User.
+	Name() string
+	// AuthCodeURL builds the redirect target for the provider's login button.
+	AuthCodeURL(state string) string
+	// FetchUser exchanges the callback code for the provider's profile.
+	FetchUser(code string) (*ProviderUser, error)
+	// AllowedDomain returns the email domain this provider is restricted
+	// to, or "" if any domain is accepted.
+	AllowedDomain() string
+}
+
+// ProviderUser is the normalized profile returned by every OAuthProvider,
+// regardless of the shape of the underlying provider's API response.
+type ProviderUser struct {
+	UID   string
+	Email string
+	Name  string
+}
+
+// Registry holds the OAuthProviders main has configured, keyed by name.
+type Registry struct {
+	providers map[string]OAuthProvider
+}
+
+// newRegistry returns an empty Registry ready for providers to be added.
+func newRegistry() *Registry {
+	return &Registry{providers: map[string]OAuthProvider{}}
+}
+
+// add registers p under p.Name(), overwriting any existing provider with
+// the same name.
+func (reg *Registry) add(p OAuthProvider) {
+	reg.providers[p.Name()] = p
+}
+
+// get looks up a provider by name, as parsed out of the callback route.
+func (reg *Registry) get(name string) (OAuthProvider, bool) {
+	p, ok := reg.providers[name]
+	return p, ok
+}
+
+// all returns the registered providers, used to render a login button per
+// provider on the index page.
+func (reg *Registry) all() map[string]OAuthProvider {
+	return reg.providers
+}
+
+var authRegistry *Registry
+
+// setupAuthProviders builds authRegistry from environment variables,
+// replacing the old single-provider setupGoogleConfig. Google, GitHub and
+// GitLab are each registered only if their client ID/secret are present;
+// the generic OIDC provider is registered whenever OIDC_ISSUER_URL is set
+// and its discovery document loads, without checking its client
+// ID/secret. Deployments can mix and match providers without code changes.
+func setupAuthProviders() {
+	authRegistry = newRegistry()
+	baseURL := os.Getenv("BASE_URL")
+
+	if id, secret := os.Getenv("GOOGLE_CLIENT_ID"), os.Getenv("GOOGLE_CLIENT_SECRET"); id != "" && secret != "" {
+		authRegistry.add(&googleProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				RedirectURL:  baseURL + "/oauth/google/callback",
+				Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
+				Endpoint:     google.Endpoint,
+			},
+			allowedDomain: os.Getenv("GOOGLE_ALLOWED_DOMAIN"),
+		})
+	}
+
+	if id, secret := os.Getenv("GITHUB_CLIENT_ID"), os.Getenv("GITHUB_CLIENT_SECRET"); id != "" && secret != "" {
+		authRegistry.add(&githubProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				RedirectURL:  baseURL + "/oauth/github/callback",
+				Scopes:       []string{"user:email"},
+				Endpoint:     github.Endpoint,
+			},
+			allowedDomain: os.Getenv("GITHUB_ALLOWED_DOMAIN"),
+		})
+	}
+
+	if id, secret := os.Getenv("GITLAB_CLIENT_ID"), os.Getenv("GITLAB_CLIENT_SECRET"); id != "" && secret != "" {
+		authRegistry.add(&gitlabProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				RedirectURL:  baseURL + "/oauth/gitlab/callback",
+				Scopes:       []string{"read_user"},
+				Endpoint:     gitlab.Endpoint,
+			},
+			allowedDomain: os.Getenv("GITLAB_ALLOWED_DOMAIN"),
+		})
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		p, err := newOIDCProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), baseURL+"/oauth/oidc/callback")
+		if err != nil {
+			log.Printf("Failed to configure generic OIDC provider: %v", err)
+		} else {
+			p.allowedDomain = os.Getenv("OIDC_ALLOWED_DOMAIN")
+			authRegistry.add(p)
+		}
+	}
+}
+
+// googleProvider is the original scvl login path, now expressed as one
+// implementation of OAuthProvider among several.
+type googleProvider struct {
+	config        *oauth2.Config
+	allowedDomain string
+}
+
+func (p *googleProvider) Name() string                    { return "google" }
+func (p *googleProvider) AuthCodeURL(state string) string { return p.config.AuthCodeURL(state) }
+func (p *googleProvider) AllowedDomain() string           { return p.allowedDomain }
+
+func (p *googleProvider) FetchUser(code string) (*ProviderUser, error) {
+	token, err := p.config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+	resp, err := p.config.Client(oauth2.NoContext, token).Get("https://www.googleapis.com/oauth2/v2/userinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch google userinfo: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode google userinfo: %w", err)
+	}
+	return &ProviderUser{UID: body.ID, Email: body.Email, Name: body.Name}, nil
+}
+
+type githubProvider struct {
+	config        *oauth2.Config
+	allowedDomain string
+}
+
+func (p *githubProvider) Name() string                    { return "github" }
+func (p *githubProvider) AuthCodeURL(state string) string { return p.config.AuthCodeURL(state) }
+func (p *githubProvider) AllowedDomain() string           { return p.allowedDomain }
+
+func (p *githubProvider) FetchUser(code string) (*ProviderUser, error) {
+	token, err := p.config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+	client := p.config.Client(oauth2.NoContext, token)
+	resp, err := client.Get("https://api.github.com/user")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch github user: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ID    int    `json:"id"`
+		Login string `json:"login"`
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode github user: %w", err)
+	}
+	email := body.Email
+	if email == "" {
+		email, err = fetchGithubPrimaryEmail(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ProviderUser{UID: strconv.Itoa(body.ID), Email: email, Name: body.Login}, nil
+}
+
+// fetchGithubPrimaryEmail covers the common case where a user's GitHub
+// email is private and doesn't appear on the /user response, requiring a
+// second call to the emails endpoint.
+func fetchGithubPrimaryEmail(client *http.Client) (string, error) {
+	resp, err := client.Get("https://api.github.com/user/emails")
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch github emails: %w", err)
+	}
+	defer resp.Body.Close()
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+		return "", fmt.Errorf("failed to decode github emails: %w", err)
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", fmt.Errorf("no verified primary email on github account")
+}
+
+type gitlabProvider struct {
+	config        *oauth2.Config
+	allowedDomain string
+}
+
+func (p *gitlabProvider) Name() string                    { return "gitlab" }
+func (p *gitlabProvider) AuthCodeURL(state string) string { return p.config.AuthCodeURL(state) }
+func (p *gitlabProvider) AllowedDomain() string           { return p.allowedDomain }
+
+func (p *gitlabProvider) FetchUser(code string) (*ProviderUser, error) {
+	token, err := p.config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+	resp, err := p.config.Client(oauth2.NoContext, token).Get("https://gitlab.com/api/v4/user")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gitlab user: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode gitlab user: %w", err)
+	}
+	return &ProviderUser{UID: strconv.Itoa(body.ID), Email: body.Email, Name: body.Username}, nil
+}
+
+// oidcProvider speaks any OpenID Connect-compliant IdP via its discovery
+// document, for deployments whose provider isn't one of the named ones above.
+type oidcProvider struct {
+	config        *oauth2.Config
+	userInfoURL   string
+	allowedDomain string
+}
+
+func newOIDCProvider(issuer, clientID, clientSecret, redirectURL string) (*oidcProvider, error) {
+	resp, err := http.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+	return &oidcProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "email", "profile"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  doc.AuthorizationEndpoint,
+				TokenURL: doc.TokenEndpoint,
+			},
+		},
+		userInfoURL: doc.UserinfoEndpoint,
+	}, nil
+}
+
+func (p *oidcProvider) Name() string                    { return "oidc" }
+func (p *oidcProvider) AuthCodeURL(state string) string { return p.config.AuthCodeURL(state) }
+func (p *oidcProvider) AllowedDomain() string           { return p.allowedDomain }
+
+func (p *oidcProvider) FetchUser(code string) (*ProviderUser, error) {
+	token, err := p.config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange token: %w", err)
+	}
+	resp, err := p.config.Client(oauth2.NoContext, token).Get(p.userInfoURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC userinfo: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Sub   string `json:"sub"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC userinfo: %w", err)
+	}
+	return &ProviderUser{UID: body.Sub, Email: body.Email, Name: body.Name}, nil
+}
+
+// checkAllowedDomain applies a provider's ALLOWED_DOMAIN-style restriction
+// to a freshly fetched ProviderUser.
+func checkAllowedDomain(p OAuthProvider, u *ProviderUser) error {
+	domain := p.AllowedDomain()
+	if domain != "" && !strings.HasSuffix(u.Email, "@"+domain) {
+		return fmt.Errorf("ログインは、%s アカウントである必要があります", domain)
+	}
+	return nil
+}
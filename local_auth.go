@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tomasen/realip"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength     = 8
+	loginRateLimitWindow  = 15 * time.Minute
+	loginRateLimitMax     = 10
+	passwordResetTokenTTL = time.Hour
+)
+
+// bcryptCost is configurable via BCRYPT_COST so the default can be tuned
+// down in tests/dev environments without recompiling.
+func bcryptCost() int {
+	if v := os.Getenv("BCRYPT_COST"); v != "" {
+		if cost, err := strconv.Atoi(v); err == nil {
+			return cost
+		}
+	}
+	return bcrypt.DefaultCost
+}
+
+// Mailer sends the emails the local-account subsystem needs (password
+// reset links, eventually signup confirmation). smtpMailer is the default;
+// tests can swap in a fake.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPMailer() *smtpMailer {
+	host := os.Getenv("SMTP_HOST")
+	port := os.Getenv("SMTP_PORT")
+	user := os.Getenv("SMTP_USER")
+	pass := os.Getenv("SMTP_PASS")
+	return &smtpMailer{
+		addr: host + ":" + port,
+		auth: smtp.PlainAuth("", user, pass, host),
+		from: os.Getenv("SMTP_FROM"),
+	}
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", m.from, to, subject, body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+var mailer Mailer
+
+func setupMailer() {
+	mailer = newSMTPMailer()
+}
+
+// loginHandler renders the local-account login form. Submission is
+// handled by authenticateLocalHandler below; kept separate so GET /login
+// can be reached even for a user who isn't authenticated yet.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, _ := getFlash(w, r, "message")
+	resp := map[string]interface{}{}
+	if bytes != nil {
+		json.Unmarshal(bytes, &resp)
+	}
+	renderTemplate(w, r, "/login.tpl", resp)
+}
+
+func authenticateLocalHandler(w http.ResponseWriter, r *http.Request) {
+	ip := realip.RealIP(r)
+	limited, err := loginRateLimitExceeded(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if limited {
+		http.Error(w, "Too many login attempts, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	email := r.FormValue("email")
+	password := r.FormValue("password")
+	user, err := manager.authenticateLocal(email, password)
+	if err != nil {
+		client.incrLoginAttempts(ip, loginRateLimitWindow)
+		bytes, _ := json.Marshal(map[string]string{"Error": "Invalid email or password."})
+		setFlash(w, "message", bytes)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	session, _ := store.Get(r, "scvl")
+	session.Values["user_id"] = user.ID
+	session.Save(r, w)
+	sessionMgr.trackSession(user.ID, session.ID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func signupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderTemplate(w, r, "/signup.tpl", map[string]interface{}{})
+		return
+	}
+
+	email := r.FormValue("email")
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("password must be at least %d characters", minPasswordLength), http.StatusUnprocessableEntity)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := manager.createLocalUser(email, string(hash))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	session, _ := store.Get(r, "scvl")
+	session.Values["user_id"] = user.ID
+	session.Save(r, w)
+	sessionMgr.trackSession(user.ID, session.ID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "scvl")
+	delete(session.Values, "user_id")
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// passwordResetHandler issues a reset token (GET form submits email here
+// via POST) or, when a token is present, consumes it and sets a new
+// password.
+func passwordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if token := r.FormValue("token"); token != "" {
+		consumePasswordReset(w, r, token)
+		return
+	}
+
+	email := r.FormValue("email")
+	user, err := manager.findUserByEmail(email)
+	if err != nil {
+		// Don't reveal whether the email is registered.
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	token, err := generateResetToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := client.setPasswordResetToken(token, user.ID, passwordResetTokenTTL); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resetURL := os.Getenv("BASE_URL") + "/password/reset?token=" + token
+	if err := mailer.Send(email, "Reset your scvl password", "Reset your password: "+resetURL); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func consumePasswordReset(w http.ResponseWriter, r *http.Request, token string) {
+	userID, err := client.getPasswordResetToken(token)
+	if err != nil {
+		http.Error(w, "Invalid or expired reset token.", http.StatusUnprocessableEntity)
+		return
+	}
+
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("password must be at least %d characters", minPasswordLength), http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := manager.updatePasswordHash(userID, string(hash)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	client.deletePasswordResetToken(token)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func generateResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func loginRateLimitExceeded(ip string) (bool, error) {
+	count, err := client.loginAttempts(ip)
+	if err != nil {
+		return false, err
+	}
+	return count >= loginRateLimitMax, nil
+}
+
+// loginAttemptKey and passwordResetKey namespace the redis keys used by
+// the local-account subsystem, mirroring the slug/OGP key helpers already
+// used by redisClient elsewhere.
+func loginAttemptKey(ip string) string     { return "login_attempts:" + ip }
+func passwordResetKey(token string) string { return "password_reset:" + token }
+
+func (c *redisClient) loginAttempts(ip string) (int, error) {
+	n, err := c.conn.Get(loginAttemptKey(ip)).Int()
+	if err != nil {
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (c *redisClient) incrLoginAttempts(ip string, window time.Duration) {
+	key := loginAttemptKey(ip)
+	c.conn.Incr(key)
+	c.conn.Expire(key, window)
+}
+
+func (c *redisClient) setPasswordResetToken(token string, userID uint, ttl time.Duration) error {
+	return c.conn.Set(passwordResetKey(token), userID, ttl).Err()
+}
+
+func (c *redisClient) getPasswordResetToken(token string) (uint, error) {
+	id, err := c.conn.Get(passwordResetKey(token)).Uint64()
+	if err != nil {
+		return 0, fmt.Errorf("reset token not found: %w", err)
+	}
+	return uint(id), nil
+}
+
+func (c *redisClient) deletePasswordResetToken(token string) {
+	c.conn.Del(passwordResetKey(token))
+}
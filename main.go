@@ -16,7 +16,6 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"github.com/mssola/user_agent"
-	qrcode "github.com/skip2/go-qrcode"
 	"github.com/tomasen/realip"
 )
 
@@ -26,7 +25,7 @@ var (
 )
 
 var client *redisClient
-var store *sessions.CookieStore
+var store sessions.Store
 
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -34,16 +33,22 @@ func main() {
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
-	store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
-
 	client, err = newRedisClient()
 	if err != nil {
 		log.Fatalf("Failed to create redisClient: %v", err)
 	}
 	defer client.Close()
+	if err := setupSessionStore(); err != nil {
+		log.Fatalf("Failed to set up session store: %v", err)
+	}
 	setupRoutes()
-	setupGoogleConfig()
+	setupAuthProviders()
+	setupMailer()
+	setupGeoResolver()
+	setupScanners()
 	setupManager()
+	startPageViewAggregator()
+	startRescanner()
 	defer manager.db.Close()
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -56,9 +61,26 @@ func setupRoutes() {
 
 	r.HandleFunc("/{slug}/qr.png", qrHandler).Methods(http.MethodGet)
 	r.Handle("/{slug}/edit", authenticate(editHandler)).Methods(http.MethodGet)
+	r.Handle("/{slug}/stats", authenticate(statsHandler)).Methods(http.MethodGet)
+	r.Handle("/{slug}/stats.csv", authenticate(statsCSVHandler)).Methods(http.MethodGet)
+	r.Handle("/{slug}/stats.json", authenticate(statsJSONHandler)).Methods(http.MethodGet)
 	r.HandleFunc("/{slug}", redirectHandler).Methods(http.MethodGet)
 	r.HandleFunc("/{slug}", authenticate(updateHandler)).Methods(http.MethodPost, http.MethodPut, http.MethodPatch)
-	r.HandleFunc("/oauth/google/callback", oauthCallbackHandler).Methods(http.MethodGet)
+	r.HandleFunc("/oauth/{provider}/callback", oauthCallbackHandler).Methods(http.MethodGet)
+	r.HandleFunc("/login", loginHandler).Methods(http.MethodGet)
+	r.HandleFunc("/login", authenticateLocalHandler).Methods(http.MethodPost)
+	r.HandleFunc("/signup", signupHandler).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/logout", logoutHandler).Methods(http.MethodPost)
+	r.HandleFunc("/password/reset", passwordResetHandler).Methods(http.MethodGet, http.MethodPost)
+	r.Handle("/account/sign-out-everywhere", authenticate(signOutEverywhereHandler)).Methods(http.MethodPost)
+	r.Handle("/account/tokens", authenticate(tokensHandler)).Methods(http.MethodGet, http.MethodPost)
+
+	r.Handle("/api/v1/shorten", apiAuthenticate(apiShortenHandler)).Methods(http.MethodPost)
+	r.Handle("/api/v1/pages", apiAuthenticate(apiListPagesHandler)).Methods(http.MethodGet)
+	r.Handle("/api/v1/pages/{slug}", apiAuthenticate(apiGetPageHandler)).Methods(http.MethodGet)
+	r.Handle("/api/v1/pages/{slug}", apiAuthenticate(apiUpdatePageHandler)).Methods(http.MethodPut, http.MethodPatch)
+	r.Handle("/api/v1/pages/{slug}", apiAuthenticate(apiDeletePageHandler)).Methods(http.MethodDelete)
+	r.Handle("/api/v1/pages/{slug}/stats", apiAuthenticate(apiPageStatsHandler)).Methods(http.MethodGet)
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("css/"))))
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("js/"))))
 	http.Handle("/", r)
@@ -77,10 +99,16 @@ func authenticate(h http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 		if !ok {
-			state := generateSlug() + generateSlug()
-			session.Values["google_state"] = state
+			loginURLs := map[string]string{}
+			states := map[string]string{}
+			for name, provider := range authRegistry.all() {
+				state := generateSlug() + generateSlug()
+				states[name] = state
+				loginURLs[name] = provider.AuthCodeURL(state)
+			}
+			session.Values["oauth_states"] = states
 			session.Save(r, w)
-			context.Set(r, "login_url", googleConfig.AuthCodeURL(state))
+			context.Set(r, "login_urls", loginURLs)
 		}
 		h.ServeHTTP(w, r)
 	}
@@ -97,58 +125,121 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		manager.setPagesToUser(user)
 		resp["User"] = user
 	}
-	loginURL, ok := context.Get(r, "login_url").(string)
+	loginURLs, ok := context.Get(r, "login_urls").(map[string]string)
 	if ok {
-		resp["LoginURL"] = loginURL
+		resp["LoginURLs"] = loginURLs
 	}
 	renderTemplate(w, r, "/index.tpl", resp)
 }
 
 func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+	provider, ok := authRegistry.get(providerName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown OAuth provider: %s", providerName), http.StatusNotFound)
+		return
+	}
+
 	session, _ := store.Get(r, "scvl")
-	retrievedState, _ := session.Values["google_state"].(string)
-	if retrievedState != r.URL.Query().Get("state") {
-		http.Error(w, fmt.Sprintf("Invalid session state: %s", retrievedState), http.StatusUnauthorized)
+	states, _ := session.Values["oauth_states"].(map[string]string)
+	if states == nil || states[providerName] != r.URL.Query().Get("state") {
+		http.Error(w, fmt.Sprintf("Invalid session state for provider: %s", providerName), http.StatusUnauthorized)
 		return
 	}
-	u, err := fetchUserInfo(r.URL.Query().Get("code"))
+
+	u, err := provider.FetchUser(r.URL.Query().Get("code"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	allowedDomain := os.Getenv("ALLOWED_DOMAIN")
-	if allowedDomain != "" && !strings.HasSuffix(u.Email, "@"+allowedDomain) {
-		http.Error(w, "ログインは、Scovilleアカウントである必要があります", http.StatusUnprocessableEntity)
+	if err := checkAllowedDomain(provider, u); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
-	user, err := manager.findOrCreateUser(u)
+	user, err := manager.findOrCreateUser(providerName, u)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	session.Values["user_id"] = user.ID
 	session.Save(r, w)
+	sessionMgr.trackSession(user.ID, session.ID)
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// signOutEverywhereHandler powers the admin "sign out everywhere" button:
+// it revokes every session belonging to the current user, which only has
+// an effect when SESSION_STORE=redis since cookie sessions carry no
+// server-side record.
+func signOutEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := context.Get(r, "user").(*User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := sessionMgr.revokeUserSessions(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
 func shortenHandler(w http.ResponseWriter, r *http.Request) {
 	user, ok := context.Get(r, "user").(*User)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+
+	limited, retryAfter, err := checkShortenRateLimit(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "Too many shorten requests, please slow down.", http.StatusTooManyRequests)
+		return
+	}
+
 	url := r.FormValue("url")
 	if url == "" {
 		http.Error(w, "url cannot be empty", http.StatusUnprocessableEntity)
 		return
 	}
+	if blocked, reason, err := scanURL(url); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if blocked {
+		http.Error(w, "This URL was rejected: "+reason, http.StatusUnprocessableEntity)
+		return
+	}
 
-	slug := generateSlug()
-	page, err := manager.createPage(user.ID, slug, url)
+	slug := r.FormValue("slug")
+	if slug == "" {
+		slug = generateSlug()
+	} else if err := validateSlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	expiresAt, err := parseExpiresAt(r.FormValue("expires_at"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	maxClicks, err := parseMaxClicks(r.FormValue("max_clicks"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	page, err := manager.createPage(user.ID, slug, url, expiresAt, maxClicks)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	client.resetClickLimit(slug, maxClicks)
 
 	if r.FormValue("ogp") == "on" {
 		ogp := OGP{
@@ -165,7 +256,7 @@ func shortenHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	client.SetURL(slug, url)
+	client.SetURLWithExpiry(slug, url, expiresAt)
 	bytes, _ := json.Marshal(map[string]string{
 		"URL":  url,
 		"Slug": slug,
@@ -176,6 +267,10 @@ func shortenHandler(w http.ResponseWriter, r *http.Request) {
 
 func redirectHandler(w http.ResponseWriter, r *http.Request) {
 	slug := mux.Vars(r)["slug"]
+	if reason, blocked := client.isBlocked(slug); blocked {
+		http.Error(w, "This link has been flagged as unsafe: "+reason, http.StatusForbidden)
+		return
+	}
 	url := client.GetURL(slug)
 	var ogp *OGP
 	if url == "" {
@@ -185,8 +280,18 @@ func redirectHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "The URL you are looking for is not found.", http.StatusNotFound)
 			return
 		}
+		if page.Blocked {
+			client.setBlocked(slug, "quarantined")
+			http.Error(w, "This link has been flagged as unsafe.", http.StatusForbidden)
+			return
+		}
+		if page.ExpiresAt != nil && page.ExpiresAt.Before(time.Now()) {
+			http.Error(w, "This link has expired.", http.StatusGone)
+			return
+		}
 		url = page.URL
-		client.SetURL(slug, url)
+		client.SetURLWithExpiry(slug, url, page.ExpiresAt)
+		client.seedClickLimitIfAbsent(slug, page.MaxClicks)
 		if page.OGP != nil {
 			ogp = page.OGP
 			client.SetOGPID(slug, int(page.OGP.ID))
@@ -194,14 +299,29 @@ func redirectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	ua := user_agent.New(r.UserAgent())
 	if !ua.Bot() {
+		if remaining, exists, err := client.decrementClicks(slug); err == nil && exists && remaining < 0 {
+			http.Error(w, "This link has reached its click limit.", http.StatusGone)
+			return
+		}
 		name, _ := ua.Browser()
+		utm := parseUTMParams(r)
+		realIP := realip.RealIP(r)
+		var country, city string
+		if geoResolver != nil {
+			country, city, _ = geoResolver.Lookup(realIP)
+		}
 		manager.createPageView(slug, PageView{
-			RealIP:      realip.RealIP(r),
+			RealIP:      realIP,
 			Referer:     r.Referer(),
 			Mobile:      ua.Mobile(),
 			Platform:    ua.Platform(),
 			OS:          ua.OS(),
 			BrowserName: name,
+			UTMSource:   utm.Source,
+			UTMMedium:   utm.Medium,
+			UTMCampaign: utm.Campaign,
+			Country:     country,
+			City:        city,
 		})
 	}
 	var ogpID int
@@ -225,21 +345,6 @@ func redirectHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func qrHandler(w http.ResponseWriter, r *http.Request) {
-	png, err := qrcode.Encode(strings.Split(r.RequestURI, "/qr.png")[0], qrcode.Medium, 256)
-	if err != nil {
-		log.Println("Failed to generate QR code: ", err)
-		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
-	if _, err := w.Write(png); err != nil {
-		log.Println("Unable to write image: ", err)
-		http.Error(w, "Unable to write image", http.StatusInternalServerError)
-	}
-}
-
 func editHandler(w http.ResponseWriter, r *http.Request) {
 	bytes, _ := getFlash(w, r, "message")
 	resp := map[string]interface{}{}
@@ -269,6 +374,9 @@ func editHandler(w http.ResponseWriter, r *http.Request) {
 	if page.OGP != nil {
 		resp["OGP"] = true
 	}
+	if remaining, exists, err := client.remainingClicks(slug); err == nil && exists {
+		resp["RemainingClicks"] = remaining
+	}
 	renderTemplate(w, r, "/edit.tpl", resp)
 }
 
@@ -296,11 +404,22 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "url cannot be empty", http.StatusUnprocessableEntity)
 		return
 	}
-	if err := manager.updatePage(page.ID, url); err != nil {
+	expiresAt, err := parseExpiresAt(r.FormValue("expires_at"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	maxClicks, err := parseMaxClicks(r.FormValue("max_clicks"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := manager.updatePage(page.ID, url, expiresAt, maxClicks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	client.SetURL(slug, url)
+	client.SetURLWithExpiry(slug, url, expiresAt)
+	client.resetClickLimit(slug, maxClicks)
 	if r.FormValue("ogp") == "on" {
 		var ogpID int
 		if page.OGP == nil {
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	qrDefaultSize  = 256
+	qrMinSize      = 64
+	qrMaxSize      = 1024
+	qrCacheTTL     = 30 * 24 * time.Hour
+	qrCacheControl = "public, max-age=2592000, immutable"
+)
+
+// qrOptions is everything a request can customize about the rendered
+// code, parsed once in qrHandler and then threaded through to whichever
+// format-specific renderer matches.
+type qrOptions struct {
+	size   int
+	ecc    qrcode.RecoveryLevel
+	format string
+	fg     color.Color
+	bg     color.Color
+	logo   string
+}
+
+func parseQROptions(r *http.Request) (qrOptions, error) {
+	q := r.URL.Query()
+	opts := qrOptions{
+		size:   qrDefaultSize,
+		ecc:    qrcode.Medium,
+		format: "png",
+		fg:     color.Black,
+		bg:     color.White,
+		logo:   q.Get("logo"),
+	}
+
+	if v := q.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < qrMinSize || size > qrMaxSize {
+			return opts, fmt.Errorf("size must be between %d and %d", qrMinSize, qrMaxSize)
+		}
+		opts.size = size
+	}
+
+	if v := q.Get("ecc"); v != "" {
+		level, ok := map[string]qrcode.RecoveryLevel{
+			"L": qrcode.Low, "M": qrcode.Medium, "Q": qrcode.High, "H": qrcode.Highest,
+		}[strings.ToUpper(v)]
+		if !ok {
+			return opts, fmt.Errorf("ecc must be one of L, M, Q, H")
+		}
+		opts.ecc = level
+	}
+
+	if v := strings.ToLower(q.Get("format")); v != "" {
+		switch v {
+		case "png", "svg", "jpeg":
+			opts.format = v
+		default:
+			return opts, fmt.Errorf("format must be one of png, svg, jpeg")
+		}
+	}
+
+	if v := q.Get("fg"); v != "" {
+		c, err := parseHexColor(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.fg = c
+	}
+	if v := q.Get("bg"); v != "" {
+		c, err := parseHexColor(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.bg = c
+	}
+
+	// Compositing a logo over the code eats into its error-correction
+	// budget, so always render at High when one is requested.
+	if opts.logo != "" {
+		opts.ecc = qrcode.High
+	}
+
+	return opts, nil
+}
+
+func parseHexColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return nil, fmt.Errorf("color must be a 6-digit hex value")
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex color: %w", err)
+	}
+	return color.RGBA{R: b[0], G: b[1], B: b[2], A: 0xff}, nil
+}
+
+// cacheKey identifies a rendered QR code by slug and the exact options
+// used to render it, so repeated scans of the same link with the same
+// query string are served from redis instead of re-encoded.
+func (o qrOptions) cacheKey(slug string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%v|%v|%s", slug, o.size, o.ecc, o.format, o.fg, o.bg, o.logo)))
+	return "qr:" + slug + "|" + hex.EncodeToString(sum[:])
+}
+
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	opts, err := parseQROptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	contentType := qrContentType(opts.format)
+	key := opts.cacheKey(slug)
+	if cached, ok := client.getQRCache(key); ok {
+		writeQRResponse(w, contentType, cached)
+		return
+	}
+
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	target := fmt.Sprintf("%s://%s/%s", scheme, r.Host, slug)
+
+	encoded, err := renderQR(target, opts)
+	if err != nil {
+		log.Println("Failed to generate QR code: ", err)
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	client.setQRCache(key, encoded, qrCacheTTL)
+	writeQRResponse(w, contentType, encoded)
+}
+
+func qrContentType(format string) string {
+	switch format {
+	case "svg":
+		return "image/svg+xml"
+	case "jpeg":
+		return "image/jpeg"
+	default:
+		return "image/png"
+	}
+}
+
+func writeQRResponse(w http.ResponseWriter, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", qrCacheControl)
+	if _, err := w.Write(body); err != nil {
+		log.Println("Unable to write image: ", err)
+	}
+}
+
+// renderQR encodes content as a QR code per opts, dispatching to the
+// format-specific renderer and, for PNG and JPEG, compositing a center
+// logo if requested. SVG output does not include the logo.
+func renderQR(content string, opts qrOptions) ([]byte, error) {
+	qr, err := qrcode.New(content, opts.ecc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build QR code: %w", err)
+	}
+	qr.ForegroundColor = colorToRGBA(opts.fg)
+	qr.BackgroundColor = colorToRGBA(opts.bg)
+
+	if opts.format == "svg" {
+		return renderQRSVG(qr, opts)
+	}
+
+	img := qr.Image(opts.size)
+	if opts.logo != "" {
+		img, err = compositeLogo(img, opts.logo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if opts.format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", opts.format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func colorToRGBA(c color.Color) color.RGBA {
+	r, g, b, a := c.RGBA()
+	return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+}
+
+// renderQRSVG walks the QR code's module bitmap and emits one <rect> per
+// dark module, since go-qrcode has no SVG writer of its own.
+func renderQRSVG(qr *qrcode.QRCode, opts qrOptions) ([]byte, error) {
+	bitmap := qr.Bitmap()
+	modules := len(bitmap)
+	if modules == 0 {
+		return nil, fmt.Errorf("empty QR bitmap")
+	}
+	scale := float64(opts.size) / float64(modules)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		opts.size, opts.size, opts.size, opts.size)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="%s"/>`, cssHex(opts.bg))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			fmt.Fprintf(&buf, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"/>`,
+				float64(x)*scale, float64(y)*scale, scale, scale, cssHex(opts.fg))
+		}
+	}
+	buf.WriteString(`</svg>`)
+	return buf.Bytes(), nil
+}
+
+func cssHex(c color.Color) string {
+	rgba := colorToRGBA(c)
+	return fmt.Sprintf("#%02x%02x%02x", rgba.R, rgba.G, rgba.B)
+}
+
+const (
+	logoFetchTimeout = 5 * time.Second
+	logoMaxBytes     = 5 << 20 // 5MiB, well past anything a reasonable logo needs
+	logoMaxRedirects = 5
+)
+
+// validateLogoURL rejects anything that isn't a plain http(s) URL
+// resolving to a public IP, so the unauthenticated qr.png?logo= endpoint
+// can't be used to make the server hit loopback/link-local/private
+// targets (e.g. cloud metadata services) -- a classic SSRF vector. It
+// returns the resolved IP so the caller can pin the actual connection to
+// it: re-resolving at dial time would let a DNS-rebinding attacker (or
+// just a short-TTL record) swap in a disallowed address after this check
+// passes.
+func validateLogoURL(rawURL string) (*url.URL, net.IP, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid logo URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil, fmt.Errorf("logo URL must be http or https")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, nil, fmt.Errorf("logo URL must have a host")
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve logo host: %w", err)
+	}
+	for _, ip := range ips {
+		if isDisallowedLogoIP(ip) {
+			return nil, nil, fmt.Errorf("logo URL resolves to a disallowed address")
+		}
+	}
+	return u, ips[0], nil
+}
+
+func isDisallowedLogoIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// fetchLogo fetches logoURL guarding against SSRF end-to-end: every
+// hostname it connects to (the original URL and each redirect hop) is
+// validated by validateLogoURL, and the connection is dialed against the
+// exact IP that validation resolved rather than letting the transport
+// re-resolve the host itself, so the checked address is the address
+// actually contacted.
+func fetchLogo(rawURL string) (io.ReadCloser, error) {
+	pinned := map[string]net.IP{}
+	validateAndPin := func(raw string) error {
+		u, ip, err := validateLogoURL(raw)
+		if err != nil {
+			return err
+		}
+		pinned[u.Hostname()] = ip
+		return nil
+	}
+
+	if err := validateAndPin(rawURL); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: logoFetchTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ip, ok := pinned[host]
+				if !ok {
+					return nil, fmt.Errorf("refusing to dial unvalidated host %q", host)
+				}
+				return (&net.Dialer{Timeout: logoFetchTimeout}).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= logoMaxRedirects {
+				return fmt.Errorf("too many redirects fetching logo")
+			}
+			return validateAndPin(req.URL.String())
+		},
+	}
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch logo: %w", err)
+	}
+	return resp.Body, nil
+}
+
+// compositeLogo draws logoURL, fetched over HTTP, centered over img at
+// roughly a fifth of its width -- small enough that opts.ecc=High can
+// still recover the obscured modules.
+func compositeLogo(img image.Image, logoURL string) (image.Image, error) {
+	body, err := fetchLogo(logoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	logo, _, err := image.Decode(io.LimitReader(body, logoMaxBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode logo: %w", err)
+	}
+
+	bounds := img.Bounds()
+	canvas := image.NewRGBA(bounds)
+	xdraw.Draw(canvas, bounds, img, image.Point{}, xdraw.Src)
+
+	logoSize := bounds.Dx() / 5
+	offset := image.Point{X: (bounds.Dx() - logoSize) / 2, Y: (bounds.Dy() - logoSize) / 2}
+	dstRect := image.Rect(offset.X, offset.Y, offset.X+logoSize, offset.Y+logoSize)
+	xdraw.CatmullRom.Scale(canvas, dstRect, logo, logo.Bounds(), xdraw.Over, nil)
+
+	return canvas, nil
+}
+
+func (c *redisClient) getQRCache(key string) ([]byte, bool) {
+	data, err := c.conn.Get(key).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *redisClient) setQRCache(key string, data []byte, ttl time.Duration) {
+	c.conn.Set(key, data, ttl)
+}
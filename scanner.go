@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanner checks a URL for malware/phishing before scvl will shorten it.
+// shortenHandler and its JSON counterpart run every configured Scanner and
+// reject on the first hit; startRescanner re-runs them against existing
+// pages so a domain that turns malicious after the fact still gets caught.
+type Scanner interface {
+	Scan(rawURL string) (blocked bool, reason string, err error)
+}
+
+var scanners []Scanner
+
+// setupScanners builds the Scanner chain from the environment: a Google
+// Safe Browsing lookup when an API key is configured, a local blocklist
+// file, and an always-on regex deny list for the most common spam
+// patterns.
+func setupScanners() {
+	scanners = nil
+	if key := os.Getenv("SAFE_BROWSING_API_KEY"); key != "" {
+		scanners = append(scanners, &safeBrowsingScanner{apiKey: key})
+	}
+	if path := os.Getenv("BLOCKLIST_FILE"); path != "" {
+		blocklist, err := newDomainBlocklistScanner(path)
+		if err != nil {
+			log.Printf("Failed to load domain blocklist %s: %v", path, err)
+		} else {
+			scanners = append(scanners, blocklist)
+		}
+	}
+	scanners = append(scanners, newDenyListScanner())
+}
+
+// scanURL runs rawURL through every configured Scanner, returning the
+// first hit.
+func scanURL(rawURL string) (blocked bool, reason string, err error) {
+	for _, s := range scanners {
+		blocked, reason, err = s.Scan(rawURL)
+		if err != nil {
+			return false, "", err
+		}
+		if blocked {
+			return true, reason, nil
+		}
+	}
+	return false, "", nil
+}
+
+// safeBrowsingScanner calls the Google Safe Browsing v4 lookup API.
+type safeBrowsingScanner struct {
+	apiKey string
+}
+
+func (s *safeBrowsingScanner) Scan(rawURL string) (bool, string, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"client": map[string]string{"clientId": "scvl", "clientVersion": "1.0.0"},
+		"threatInfo": map[string]interface{}{
+			"threatTypes":      []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE"},
+			"platformTypes":    []string{"ANY_PLATFORM"},
+			"threatEntryTypes": []string{"URL"},
+			"threatEntries":    []map[string]string{{"url": rawURL}},
+		},
+	})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to build Safe Browsing request: %w", err)
+	}
+
+	endpoint := "https://safebrowsing.googleapis.com/v4/threatMatches:find?key=" + s.apiKey
+	resp, err := http.Post(endpoint, "application/json", strings.NewReader(string(reqBody)))
+	if err != nil {
+		return false, "", fmt.Errorf("failed to call Safe Browsing API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Matches []struct {
+			ThreatType string `json:"threatType"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, "", fmt.Errorf("failed to decode Safe Browsing response: %w", err)
+	}
+	if len(result.Matches) > 0 {
+		return true, "flagged by Google Safe Browsing: " + result.Matches[0].ThreatType, nil
+	}
+	return false, "", nil
+}
+
+// domainBlocklistScanner rejects URLs whose host matches a line in a
+// plain-text file, one domain per line.
+type domainBlocklistScanner struct {
+	domains map[string]bool
+}
+
+func newDomainBlocklistScanner(path string) (*domainBlocklistScanner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		domain := strings.TrimSpace(scanner.Text())
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+		domains[strings.ToLower(domain)] = true
+	}
+	return &domainBlocklistScanner{domains: domains}, nil
+}
+
+func (s *domainBlocklistScanner) Scan(rawURL string) (bool, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false, "", fmt.Errorf("invalid URL: %w", err)
+	}
+	host := strings.ToLower(u.Hostname())
+	if s.domains[host] {
+		return true, "domain is on the blocklist: " + host, nil
+	}
+	return false, "", nil
+}
+
+// denyListScanner rejects URLs matching a fixed set of regexes covering
+// common phishing/spam patterns (IP-literal hosts, punycode homograph
+// domains, etc). It's always enabled, unlike the two scanners above.
+type denyListScanner struct {
+	patterns []*regexp.Regexp
+}
+
+func newDenyListScanner() *denyListScanner {
+	return &denyListScanner{
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`://\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}`), // raw IP-literal hosts
+			regexp.MustCompile(`xn--`),                                  // punycode homograph domains
+		},
+	}
+}
+
+func (s *denyListScanner) Scan(rawURL string) (bool, string, error) {
+	for _, pattern := range s.patterns {
+		if pattern.MatchString(rawURL) {
+			return true, "matched deny-list pattern: " + pattern.String(), nil
+		}
+	}
+	return false, "", nil
+}
+
+const (
+	rescanInterval   = 24 * time.Hour
+	shortenRateLimit = time.Minute
+)
+
+// startRescanner periodically re-scans every stored page so a domain that
+// turns malicious after it was shortened still gets quarantined; matching
+// pages are flagged Blocked so redirectHandler can show a warning instead
+// of redirecting.
+func startRescanner() {
+	ticker := time.NewTicker(rescanInterval)
+	go func() {
+		for range ticker.C {
+			pages, err := manager.allPages()
+			if err != nil {
+				log.Printf("Failed to list pages for rescan: %v", err)
+				continue
+			}
+			for _, page := range pages {
+				blocked, reason, err := scanURL(page.URL)
+				if err != nil {
+					log.Printf("Failed to rescan %s: %v", page.Slug, err)
+					continue
+				}
+				if blocked {
+					if err := manager.blockPage(page.ID, reason); err != nil {
+						log.Printf("Failed to quarantine %s: %v", page.Slug, err)
+						continue
+					}
+					client.setBlocked(page.Slug, reason)
+				}
+			}
+		}
+	}()
+}
+
+// shortenRateLimitKey and shortenRateLimitMax implement a per-user token
+// bucket for POST /shorten and /api/v1/shorten, refilled once per
+// shortenRateLimit window. The per-role limit defaults to 30/min but can
+// be tuned via SHORTEN_RATE_LIMIT_<ROLE>.
+func shortenRateLimitKey(userID uint) string { return fmt.Sprintf("shorten_rate:%d", userID) }
+
+func shortenRateLimitMax(role string) int {
+	if v := os.Getenv("SHORTEN_RATE_LIMIT_" + strings.ToUpper(role)); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 30
+}
+
+func blockedKey(slug string) string { return "blocked:" + slug }
+
+// setBlocked records that a slug has been quarantined, so redirectHandler
+// can reject it even while serving the URL from redis cache.
+func (c *redisClient) setBlocked(slug, reason string) {
+	c.conn.Set(blockedKey(slug), reason, 0)
+}
+
+func (c *redisClient) isBlocked(slug string) (reason string, blocked bool) {
+	reason, err := c.conn.Get(blockedKey(slug)).Result()
+	if err != nil {
+		return "", false
+	}
+	return reason, true
+}
+
+// checkShortenRateLimit enforces the bucket above, returning the
+// Retry-After seconds a caller should wait when over limit.
+func checkShortenRateLimit(user *User) (limited bool, retryAfter int, err error) {
+	key := shortenRateLimitKey(user.ID)
+	count, err := client.conn.Incr(key).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	if count == 1 {
+		client.conn.Expire(key, shortenRateLimit)
+	}
+	if count > int64(shortenRateLimitMax(user.Role)) {
+		ttl, _ := client.conn.TTL(key).Result()
+		return true, int(ttl.Seconds()), nil
+	}
+	return false, 0, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boj/redistore"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/sessions"
+)
+
+// sessionManager wraps the gorilla sessions.Store scvl is configured to
+// use (cookie or redis, per SESSION_STORE); handlers reach it through the
+// sessions.Store-typed store variable instead of a concrete store. Redis-backed sessions additionally
+// support server-side revocation, which cookie sessions can't offer.
+type sessionManager struct {
+	sessions.Store
+	backend string
+}
+
+// sessionMgr is the process-wide sessionManager instance, set up in
+// setupSessionStore alongside the existing redis client and DB manager.
+var sessionMgr *sessionManager
+
+// setupSessionStore replaces the old unconditional sessions.NewCookieStore
+// call in main with a choice between cookie and redis storage, selected by
+// the SESSION_STORE env var ("cookie" or "redis", default "cookie").
+func setupSessionStore() error {
+	secret := []byte(os.Getenv("SESSION_SECRET"))
+
+	switch os.Getenv("SESSION_STORE") {
+	case "redis":
+		rs, err := redistore.NewRediStoreWithPool(client.pool(), secret)
+		if err != nil {
+			return fmt.Errorf("failed to create redis session store: %w", err)
+		}
+		sessionMgr = &sessionManager{Store: rs, backend: "redis"}
+	default:
+		sessionMgr = &sessionManager{Store: sessions.NewCookieStore(secret), backend: "cookie"}
+	}
+	store = sessionMgr
+	return nil
+}
+
+// revokeUserSessions invalidates every active session belonging to
+// userID. Only meaningful for the redis backend, since cookie sessions
+// have no server-side record to delete; cookie-backed deployments should
+// rely on rotating SESSION_SECRET instead.
+func (m *sessionManager) revokeUserSessions(userID uint) error {
+	if m.backend != "redis" {
+		return fmt.Errorf("sign out everywhere requires SESSION_STORE=redis")
+	}
+	return client.deleteUserSessionIndex(userID)
+}
+
+// trackSession records that userID owns the given session key, so a later
+// revokeUserSessions call knows which redis keys to delete.
+func (m *sessionManager) trackSession(userID uint, sessionID string) error {
+	if m.backend != "redis" {
+		return nil
+	}
+	return client.addUserSessionIndex(userID, sessionID)
+}
+
+// pool builds a redigo pool pointed at the same address/password the
+// go-redis-based redisClient was already configured with, so redistore
+// shares scvl's one source of Redis connection config instead of each
+// reading REDIS_ADDR/REDIS_PASSWORD independently.
+func (c *redisClient) pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", c.addr, redis.DialPassword(c.password))
+		},
+	}
+}
+
+func userSessionIndexKey(userID uint) string {
+	return fmt.Sprintf("user_sessions:%d", userID)
+}
+
+// addUserSessionIndex and deleteUserSessionIndex maintain a redis set of
+// session IDs per user so revokeUserSessions can delete them all without
+// scanning the whole redistore keyspace.
+func (c *redisClient) addUserSessionIndex(userID uint, sessionID string) error {
+	return c.conn.SAdd(userSessionIndexKey(userID), sessionID).Err()
+}
+
+func (c *redisClient) deleteUserSessionIndex(userID uint) error {
+	key := userSessionIndexKey(userID)
+	sessionIDs, err := c.conn.SMembers(key).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list sessions for user %d: %w", userID, err)
+	}
+	for _, sid := range sessionIDs {
+		// redistore prefixes its redis keys with "session_"; see
+		// RediStore.SetMaxLength / the package's default keyPrefix.
+		c.conn.Del("session_" + sid)
+	}
+	return c.conn.Del(key).Err()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// slugPattern mirrors the shape generateSlug() already produces, but wide
+// enough to allow user-chosen slugs too.
+var slugPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,32}$`)
+
+// reservedSlugs are the path segments scvl's router already claims, so a
+// custom slug can't shadow them.
+var reservedSlugs = map[string]bool{
+	"css": true, "js": true, "oauth": true, "login": true, "signup": true,
+	"logout": true, "password": true, "account": true, "api": true,
+	"shorten": true,
+}
+
+// validateSlug rejects custom slugs that don't match the allowed
+// character set or that would collide with an existing route.
+func validateSlug(slug string) error {
+	if !slugPattern.MatchString(slug) {
+		return fmt.Errorf("slug must be 3-32 characters of letters, digits, - or _")
+	}
+	if reservedSlugs[slug] {
+		return fmt.Errorf("slug %q is reserved", slug)
+	}
+	return nil
+}
+
+// parseExpiresAt parses the optional expires_at form value (RFC3339),
+// returning a nil time when the field is blank.
+func parseExpiresAt(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("expires_at must be RFC3339: %w", err)
+	}
+	return &t, nil
+}
+
+// parseMaxClicks parses the optional max_clicks form value, returning 0
+// (unlimited) when the field is blank.
+func parseMaxClicks(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("max_clicks must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func clickLimitKey(slug string) string { return "clicks:" + slug }
+
+// resetClickLimit (re)seeds the redis counter redirectHandler decrements
+// on every hit, unconditionally overwriting whatever remained. Use this
+// only where MaxClicks is genuinely changing -- page creation, or an
+// explicit edit -- never on a cache-miss repopulate, or a Redis restart
+// would silently refill an already-partially-consumed budget.
+func (c *redisClient) resetClickLimit(slug string, maxClicks int) error {
+	if maxClicks <= 0 {
+		return c.conn.Del(clickLimitKey(slug)).Err()
+	}
+	return c.conn.Set(clickLimitKey(slug), maxClicks, 0).Err()
+}
+
+// seedClickLimitIfAbsent sets the counter only if it isn't already
+// present, so repopulating the cache on a redirect miss can't reset a
+// counter that's already been partly consumed.
+func (c *redisClient) seedClickLimitIfAbsent(slug string, maxClicks int) error {
+	if maxClicks <= 0 {
+		return nil
+	}
+	return c.conn.SetNX(clickLimitKey(slug), maxClicks, 0).Err()
+}
+
+// decrementClicks atomically decrements the remaining-click counter for
+// slug. exists is false when the page has no click limit configured, in
+// which case remaining is meaningless and the caller should just proceed.
+func (c *redisClient) decrementClicks(slug string) (remaining int64, exists bool, err error) {
+	n, err := c.conn.Exists(clickLimitKey(slug)).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	remaining, err = c.conn.Decr(clickLimitKey(slug)).Result()
+	if err != nil {
+		return 0, true, err
+	}
+	return remaining, true, nil
+}
+
+// remainingClicks reads, without consuming, the click counter set by
+// resetClickLimit or seedClickLimitIfAbsent. Used by the dashboard to show remaining clicks without
+// affecting the count a real redirect would decrement.
+func (c *redisClient) remainingClicks(slug string) (remaining int64, exists bool, err error) {
+	n, err := c.conn.Exists(clickLimitKey(slug)).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, false, nil
+	}
+	remaining, err = c.conn.Get(clickLimitKey(slug)).Int64()
+	if err != nil {
+		return 0, true, err
+	}
+	return remaining, true, nil
+}
+
+// SetURLWithExpiry is SetURL plus an optional hard expiry, propagated to
+// redis via EXPIREAT so the cached redirect drops out on its own instead
+// of relying on every caller to re-check expiresAt.
+func (c *redisClient) SetURLWithExpiry(slug, url string, expiresAt *time.Time) {
+	c.SetURL(slug, url)
+	if expiresAt != nil {
+		c.conn.ExpireAt(slug, *expiresAt)
+	}
+}